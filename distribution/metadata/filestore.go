@@ -0,0 +1,113 @@
+package metadata
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/docker/distribution/digest"
+)
+
+// FSMetadataStore is a Store implementation that keeps the V2Metadata
+// slice for each DiffID in its own JSON file under a root directory,
+// namespaced by digest algorithm the same way the on-disk layer store is.
+type FSMetadataStore struct {
+	mu   sync.RWMutex
+	root string
+}
+
+// NewFSMetadataStore returns a Store rooted at root, creating the
+// directory if it doesn't already exist.
+func NewFSMetadataStore(root string) (*FSMetadataStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &FSMetadataStore{root: root}, nil
+}
+
+func (s *FSMetadataStore) path(diffID digest.Digest) string {
+	return filepath.Join(s.root, string(diffID.Algorithm()), diffID.Hex())
+}
+
+// Get returns the V2Metadata entries recorded for diffID, or nil if none
+// have been recorded.
+func (s *FSMetadataStore) Get(diffID digest.Digest) ([]V2Metadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getLocked(diffID)
+}
+
+func (s *FSMetadataStore) getLocked(diffID digest.Digest) ([]V2Metadata, error) {
+	data, err := ioutil.ReadFile(s.path(diffID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var all []V2Metadata
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// Add records metadata for diffID, skipping the write if an identical
+// entry is already present.
+func (s *FSMetadataStore) Add(diffID digest.Digest, metadata V2Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.getLocked(diffID)
+	if err != nil {
+		return err
+	}
+	for _, existing := range all {
+		if existing == metadata {
+			return nil
+		}
+	}
+	all = append(all, metadata)
+
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+
+	path := s.path(diffID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Remove deletes a previously recorded metadata entry for diffID, if
+// present.
+func (s *FSMetadataStore) Remove(diffID digest.Digest, metadata V2Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.getLocked(diffID)
+	if err != nil {
+		return err
+	}
+
+	filtered := all[:0]
+	for _, existing := range all {
+		if existing != metadata {
+			filtered = append(filtered, existing)
+		}
+	}
+	if len(filtered) == len(all) {
+		return nil
+	}
+
+	data, err := json.Marshal(filtered)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path(diffID), data, 0600)
+}
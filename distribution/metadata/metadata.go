@@ -0,0 +1,28 @@
+// Package metadata provides a persistent store mapping a layer's DiffID to
+// the blob digests under which its content is known to already exist on
+// remote repositories, so that a push of a re-tagged image doesn't have to
+// re-upload layers the registry already has.
+package metadata
+
+import "github.com/docker/distribution/digest"
+
+// V2Metadata records that a layer's uncompressed content (identified by its
+// DiffID) was observed, during a pull, to correspond to a specific blob
+// digest on SourceRepository. HMAC authenticates SourceRepository so a
+// mapping learned while pulling from one repository is never blindly
+// trusted for a push to a different, untrusted one.
+type V2Metadata struct {
+	Digest           digest.Digest
+	SourceRepository string
+	HMAC             string
+}
+
+// Store is a storage backend for V2Metadata, keyed by the DiffID of the
+// layer it describes. A single DiffID can have more than one associated
+// V2Metadata entry, since the same layer content may have been seen on
+// multiple source repositories.
+type Store interface {
+	Get(diffID digest.Digest) ([]V2Metadata, error)
+	Add(diffID digest.Digest, metadata V2Metadata) error
+	Remove(diffID digest.Digest, metadata V2Metadata) error
+}
@@ -0,0 +1,135 @@
+package metadata
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func newTestFSStore(t *testing.T) (*FSMetadataStore, func()) {
+	root, err := ioutil.TempDir("", "v2metadata-test-")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	store, err := NewFSMetadataStore(root)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatalf("NewFSMetadataStore: %v", err)
+	}
+	return store, func() { os.RemoveAll(root) }
+}
+
+func TestFSMetadataStoreRoundTrip(t *testing.T) {
+	store, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	diffID := digest.Digest("sha256:aaaa")
+	entry := V2Metadata{Digest: digest.Digest("sha256:bbbb"), SourceRepository: "library/busybox", HMAC: "mac"}
+
+	if err := store.Add(diffID, entry); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	got, err := store.Get(diffID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if len(got) != 1 || got[0] != entry {
+		t.Fatalf("Get = %+v, want [%+v]", got, entry)
+	}
+
+	if err := store.Remove(diffID, entry); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	got, err = store.Get(diffID)
+	if err != nil {
+		t.Fatalf("Get after Remove: %v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("Get after Remove = %+v, want empty", got)
+	}
+}
+
+func TestFSMetadataStoreGetMissingIsNotError(t *testing.T) {
+	store, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	got, err := store.Get(digest.Digest("sha256:cccc"))
+	if err != nil {
+		t.Fatalf("Get on missing diffID returned error: %v", err)
+	}
+	if got != nil {
+		t.Fatalf("Get on missing diffID = %+v, want nil", got)
+	}
+}
+
+func TestV2MetadataServiceRoundTrip(t *testing.T) {
+	store, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	svc := NewV2MetadataService(store, []byte("secret-key"))
+	diffID := digest.Digest("sha256:aaaa")
+	blobDigest := digest.Digest("sha256:bbbb")
+
+	if err := svc.Add(diffID, "library/busybox", blobDigest); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	got, err := svc.GetDigest(diffID, "library/busybox")
+	if err != nil {
+		t.Fatalf("GetDigest: %v", err)
+	}
+	if got != blobDigest {
+		t.Fatalf("GetDigest = %q, want %q", got, blobDigest)
+	}
+}
+
+func TestV2MetadataServiceRejectsUntrustedRepository(t *testing.T) {
+	store, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	svc := NewV2MetadataService(store, []byte("secret-key"))
+	diffID := digest.Digest("sha256:aaaa")
+	blobDigest := digest.Digest("sha256:bbbb")
+
+	if err := svc.Add(diffID, "library/busybox", blobDigest); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	got, err := svc.GetDigest(diffID, "library/other")
+	if err != nil {
+		t.Fatalf("GetDigest: %v", err)
+	}
+	if got != "" {
+		t.Fatalf("GetDigest for a different repository = %q, want \"\" (mapping must not leak across repositories)", got)
+	}
+}
+
+func TestV2MetadataServiceRejectsForgedHMAC(t *testing.T) {
+	store, cleanup := newTestFSStore(t)
+	defer cleanup()
+
+	diffID := digest.Digest("sha256:aaaa")
+	blobDigest := digest.Digest("sha256:bbbb")
+
+	// Simulate an entry written (or tampered with) under a different HMAC
+	// key than the one the reading service uses.
+	if err := store.Add(diffID, V2Metadata{
+		Digest:           blobDigest,
+		SourceRepository: "library/busybox",
+		HMAC:             NewV2MetadataService(store, []byte("attacker-key")).computeHMAC("library/busybox"),
+	}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	svc := NewV2MetadataService(store, []byte("real-key"))
+	got, err := svc.GetDigest(diffID, "library/busybox")
+	if err != nil {
+		t.Fatalf("GetDigest: %v", err)
+	}
+	if got != "" {
+		t.Fatalf("GetDigest with a forged HMAC = %q, want \"\" (entry should be rejected)", got)
+	}
+}
@@ -0,0 +1,59 @@
+package metadata
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/docker/distribution/digest"
+)
+
+// V2MetadataService wraps a Store and scopes lookups to a specific source
+// repository name, authenticated with an HMAC so that a mapping learned
+// while pulling from one repository is never trusted for a push to a
+// repository with a different name. The name does not include the registry
+// host, so repositories of the same name on different registries share
+// their entries.
+type V2MetadataService struct {
+	store   Store
+	hmacKey []byte
+}
+
+// NewV2MetadataService returns a V2MetadataService backed by store, using
+// key to compute the HMAC recorded alongside each entry's source
+// repository.
+func NewV2MetadataService(store Store, key []byte) *V2MetadataService {
+	return &V2MetadataService{store: store, hmacKey: key}
+}
+
+// Add records that diffID's uncompressed content is known to correspond to
+// dgst on sourceRepository.
+func (s *V2MetadataService) Add(diffID digest.Digest, sourceRepository string, dgst digest.Digest) error {
+	return s.store.Add(diffID, V2Metadata{
+		Digest:           dgst,
+		SourceRepository: sourceRepository,
+		HMAC:             s.computeHMAC(sourceRepository),
+	})
+}
+
+// GetDigest returns the blob digest previously recorded for diffID on
+// sourceRepository, or "" if no entry trusted for that repository exists.
+func (s *V2MetadataService) GetDigest(diffID digest.Digest, sourceRepository string) (digest.Digest, error) {
+	all, err := s.store.Get(diffID)
+	if err != nil {
+		return "", err
+	}
+	want := s.computeHMAC(sourceRepository)
+	for _, m := range all {
+		if m.SourceRepository == sourceRepository && hmac.Equal([]byte(m.HMAC), []byte(want)) {
+			return m.Digest, nil
+		}
+	}
+	return "", nil
+}
+
+func (s *V2MetadataService) computeHMAC(sourceRepository string) string {
+	mac := hmac.New(sha256.New, s.hmacKey)
+	mac.Write([]byte(sourceRepository))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,220 @@
+// Package xfer provides a generic mechanism for scheduling content
+// transfers (such as layer downloads) with bounded concurrency,
+// deduplication of overlapping requests, and retry with backoff.
+package xfer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultMaxConcurrentDownloads is the default value used by
+	// NewTransferManager when the caller doesn't override the concurrency
+	// limit (e.g. daemon configuration left at its zero value).
+	DefaultMaxConcurrentDownloads = 3
+
+	maxDownloadAttempts = 5
+	initialBackoff      = 1 * time.Second
+	maxBackoff          = 1 * time.Minute
+)
+
+// Progress describes a single progress update for a transfer in flight.
+type Progress struct {
+	ID             string
+	Action         string
+	Current, Total int64
+}
+
+// DownloadFunc performs one attempt at transferring content, starting
+// offset bytes into it (0 on the first attempt, or whenever a previous
+// attempt could not be resumed). It reports progress through
+// progressOutput and returns the total number of bytes now written (not
+// just those written during this attempt, since a failed resume may have
+// reset the destination back to the start), so the manager knows where to
+// resume from if a retry is needed.
+type DownloadFunc func(ctx context.Context, offset int64, progressOutput func(Progress)) (written int64, err error)
+
+// Watcher receives progress updates for a Job that one or more callers are
+// waiting on.
+type Watcher struct {
+	C chan Progress
+}
+
+// Job tracks a single, possibly shared, in-progress transfer.
+type Job struct {
+	mu       sync.Mutex
+	watchers map[*Watcher]struct{}
+	done     chan struct{}
+	err      error
+}
+
+func newJob() *Job {
+	return &Job{
+		watchers: make(map[*Watcher]struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Watch registers a new subscriber for progress updates on this job. The
+// returned Watcher must eventually be passed to Unwatch.
+func (j *Job) Watch() *Watcher {
+	w := &Watcher{C: make(chan Progress, 100)}
+	j.mu.Lock()
+	j.watchers[w] = struct{}{}
+	j.mu.Unlock()
+	return w
+}
+
+// Unwatch stops delivering progress updates to w and closes its channel.
+func (j *Job) Unwatch(w *Watcher) {
+	j.mu.Lock()
+	delete(j.watchers, w)
+	close(w.C)
+	j.mu.Unlock()
+}
+
+func (j *Job) broadcast(p Progress) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for w := range j.watchers {
+		select {
+		case w.C <- p:
+		default:
+			// Slow watcher; drop the update rather than block the transfer.
+		}
+	}
+}
+
+func (j *Job) finish(err error) {
+	j.mu.Lock()
+	j.err = err
+	j.mu.Unlock()
+	close(j.done)
+}
+
+// Done returns a channel that's closed once the job has finished,
+// successfully or not.
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Err returns the error the job finished with, if any. Only meaningful
+// after Done() has been closed.
+func (j *Job) Err() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.err
+}
+
+// TransferManager runs transfers with a bounded level of concurrency,
+// deduplicates concurrent requests for the same key so overlapping pulls
+// share a single download, and retries failed attempts with exponential
+// backoff. Callers should call Wait after cancelling or erroring out so
+// that no goroutine started by the manager is left writing to a response
+// that has already been closed.
+type TransferManager struct {
+	mu        sync.Mutex
+	sem       chan struct{}
+	jobs      map[string]*Job
+	waitGroup sync.WaitGroup
+}
+
+// NewTransferManager returns a TransferManager that allows at most
+// maxConcurrentDownloads transfers to run at once.
+func NewTransferManager(maxConcurrentDownloads int) *TransferManager {
+	if maxConcurrentDownloads < 1 {
+		maxConcurrentDownloads = DefaultMaxConcurrentDownloads
+	}
+	return &TransferManager{
+		sem:  make(chan struct{}, maxConcurrentDownloads),
+		jobs: make(map[string]*Job),
+	}
+}
+
+// Download runs fn under the manager's concurrency limit and retry policy.
+// If a download for the same key is already in flight, the caller is
+// attached to it via a new Watcher instead of starting a duplicate fetch.
+// The returned Job can be waited on for completion via Done()/Err(), and
+// watched for progress via the returned Watcher (release it with
+// Job.Unwatch when no longer needed).
+func (tm *TransferManager) Download(ctx context.Context, key string, fn DownloadFunc) (*Job, *Watcher) {
+	tm.mu.Lock()
+	if j, ok := tm.jobs[key]; ok {
+		tm.mu.Unlock()
+		return j, j.Watch()
+	}
+
+	j := newJob()
+	tm.jobs[key] = j
+	w := j.Watch()
+	tm.mu.Unlock()
+
+	tm.waitGroup.Add(1)
+	go func() {
+		defer tm.waitGroup.Done()
+		defer func() {
+			tm.mu.Lock()
+			delete(tm.jobs, key)
+			tm.mu.Unlock()
+		}()
+
+		select {
+		case tm.sem <- struct{}{}:
+		case <-ctx.Done():
+			j.finish(ctx.Err())
+			return
+		}
+		defer func() { <-tm.sem }()
+
+		j.finish(runWithRetries(ctx, fn, j.broadcast))
+	}()
+
+	return j, w
+}
+
+// Wait blocks until every transfer started through this manager has
+// returned.
+func (tm *TransferManager) Wait() {
+	tm.waitGroup.Wait()
+}
+
+// runWithRetries calls fn until it succeeds, ctx is cancelled, or
+// maxDownloadAttempts is reached, applying exponential backoff between
+// attempts and resuming from the offset reported by previous attempts.
+func runWithRetries(ctx context.Context, fn DownloadFunc, progressOutput func(Progress)) error {
+	var (
+		offset  int64
+		lastErr error
+	)
+	backoff := initialBackoff
+
+	for attempt := 0; attempt < maxDownloadAttempts; attempt++ {
+		if attempt > 0 {
+			logrus.Debugf("retrying download (attempt %d/%d) after %v: %v", attempt+1, maxDownloadAttempts, backoff, lastErr)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+
+		written, err := fn(ctx, offset, progressOutput)
+		offset = written
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		lastErr = err
+	}
+	return lastErr
+}
@@ -0,0 +1,78 @@
+package xfer
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestRunWithRetriesSucceedsAfterFailures(t *testing.T) {
+	var attempts int
+	err := runWithRetries(context.Background(), func(ctx context.Context, offset int64, progressOutput func(Progress)) (int64, error) {
+		attempts++
+		if attempts < 3 {
+			return offset, errors.New("transient failure")
+		}
+		return offset + 1, nil
+	}, func(Progress) {})
+
+	if err != nil {
+		t.Fatalf("expected eventual success, got error: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("attempts = %d, want 3", attempts)
+	}
+}
+
+func TestRunWithRetriesGivesUpAfterMaxAttempts(t *testing.T) {
+	var attempts int
+	wantErr := errors.New("permanent failure")
+	err := runWithRetries(context.Background(), func(ctx context.Context, offset int64, progressOutput func(Progress)) (int64, error) {
+		attempts++
+		return offset, wantErr
+	}, func(Progress) {})
+
+	if err != wantErr {
+		t.Fatalf("err = %v, want %v", err, wantErr)
+	}
+	if attempts != maxDownloadAttempts {
+		t.Fatalf("attempts = %d, want %d", attempts, maxDownloadAttempts)
+	}
+}
+
+func TestRunWithRetriesResumesFromLastOffset(t *testing.T) {
+	var gotOffsets []int64
+	err := runWithRetries(context.Background(), func(ctx context.Context, offset int64, progressOutput func(Progress)) (int64, error) {
+		gotOffsets = append(gotOffsets, offset)
+		if len(gotOffsets) < 2 {
+			return 42, errors.New("transient failure")
+		}
+		return 42, nil
+	}, func(Progress) {})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(gotOffsets) != 2 || gotOffsets[0] != 0 || gotOffsets[1] != 42 {
+		t.Fatalf("gotOffsets = %v, want [0 42]", gotOffsets)
+	}
+}
+
+func TestRunWithRetriesStopsOnCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var attempts int
+	err := runWithRetries(ctx, func(ctx context.Context, offset int64, progressOutput func(Progress)) (int64, error) {
+		attempts++
+		return offset, errors.New("transient failure")
+	}, func(Progress) {})
+
+	if err != context.Canceled {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("attempts = %d, want 1 (should stop retrying once cancelled)", attempts)
+	}
+}
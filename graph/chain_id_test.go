@@ -0,0 +1,37 @@
+package graph
+
+import (
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestCreateChainIDBaseLayer(t *testing.T) {
+	diffID := digest.Digest("sha256:aaaa")
+	if got := createChainID("", diffID); got != diffID {
+		t.Fatalf("createChainID(\"\", %q) = %q, want %q (base layer's ChainID is its own DiffID)", diffID, got, diffID)
+	}
+}
+
+func TestCreateChainIDIsDeterministic(t *testing.T) {
+	parent := digest.Digest("sha256:aaaa")
+	diffID := digest.Digest("sha256:bbbb")
+
+	got1 := createChainID(parent, diffID)
+	got2 := createChainID(parent, diffID)
+	if got1 != got2 {
+		t.Fatalf("createChainID is not deterministic: %q != %q", got1, got2)
+	}
+	if got1 == parent || got1 == diffID {
+		t.Fatalf("createChainID(%q, %q) = %q, should differ from both inputs", parent, diffID, got1)
+	}
+}
+
+func TestCreateChainIDDependsOnParent(t *testing.T) {
+	diffID := digest.Digest("sha256:bbbb")
+	a := createChainID(digest.Digest("sha256:aaaa"), diffID)
+	b := createChainID(digest.Digest("sha256:cccc"), diffID)
+	if a == b {
+		t.Fatalf("createChainID should differ when parent differs: got %q for both", a)
+	}
+}
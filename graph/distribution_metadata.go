@@ -0,0 +1,65 @@
+package graph
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/docker/distribution/metadata"
+	"golang.org/x/net/context"
+)
+
+// distributionMetadataDir is where the V2 metadata store keeps its
+// per-DiffID JSON files, relative to the TagStore's root.
+const distributionMetadataDir = "distribution"
+
+var (
+	distributionMetadataOnce sync.Once
+	distributionMetadataSvc  *metadata.V2MetadataService
+	distributionMetadataErr  error
+)
+
+// v2MetadataService lazily constructs, once per daemon process, the
+// V2MetadataService shared by every v2Puller built against this TagStore
+// (and, on the push side, by layerAlreadyOnRegistry below) so that a
+// mapping recorded on one pull is visible to later pulls and to a
+// subsequent push of the same content, rather than being rebuilt - and so
+// losing everything it already knew - on every pull.
+func (store *TagStore) v2MetadataService() (*metadata.V2MetadataService, error) {
+	distributionMetadataOnce.Do(func() {
+		fsStore, err := metadata.NewFSMetadataStore(filepath.Join(store.path, distributionMetadataDir))
+		if err != nil {
+			distributionMetadataErr = err
+			return
+		}
+		distributionMetadataSvc = metadata.NewV2MetadataService(fsStore, []byte(store.trustKey.PublicKey().KeyID()))
+	})
+	return distributionMetadataSvc, distributionMetadataErr
+}
+
+// layerAlreadyOnRegistry consults the V2 metadata store built up by
+// v2Puller.recordV2Metadata during pulls to see whether diffID's content is
+// already known to exist on repo under some blob digest, so pushLayer can
+// skip re-uploading it entirely. The candidate is re-confirmed with a Stat
+// call, since the registry may have garbage-collected the blob since the
+// mapping was recorded.
+func (store *TagStore) layerAlreadyOnRegistry(ctx context.Context, repo distribution.Repository, diffID digest.Digest) (digest.Digest, bool) {
+	metadataService, err := store.v2MetadataService()
+	if err != nil {
+		logrus.Debugf("Unable to access distribution metadata store: %v", err)
+		return "", false
+	}
+
+	dgst, err := metadataService.GetDigest(diffID, repo.Name())
+	if err != nil || dgst == "" {
+		return "", false
+	}
+
+	if _, err := repo.Blobs(ctx).Stat(ctx, dgst); err != nil {
+		logrus.Debugf("Layer %s no longer present on %s despite recorded metadata: %v", diffID, repo.Name(), err)
+		return "", false
+	}
+	return dgst, true
+}
@@ -0,0 +1,17 @@
+package graph
+
+import "testing"
+
+func TestIsHTTPSURL(t *testing.T) {
+	cases := map[string]bool{
+		"https://example.com/layer.tar.gz": true,
+		"http://example.com/layer.tar.gz":  false,
+		"ftp://example.com/layer.tar.gz":   false,
+		"":                                 false,
+	}
+	for rawurl, want := range cases {
+		if got := isHTTPSURL(rawurl); got != want {
+			t.Errorf("isHTTPSURL(%q) = %v, want %v", rawurl, got, want)
+		}
+	}
+}
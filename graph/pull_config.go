@@ -0,0 +1,38 @@
+package graph
+
+import (
+	"io"
+
+	"github.com/docker/docker/cliconfig"
+)
+
+// ImagePullConfig stores options for Pull operations.
+type ImagePullConfig struct {
+	// MetaHeaders store HTTP headers with metadata about the image
+	MetaHeaders map[string][]string
+	// AuthConfig holds authentication credentials for authenticating with
+	// the registry.
+	AuthConfig *cliconfig.AuthConfig
+	// OutStream is the output writer for progress and status information.
+	OutStream io.Writer
+	// Platform, if non-empty, overrides the daemon's runtime.GOOS/GOARCH
+	// when selecting an entry from a multi-architecture manifest list (see
+	// v2Puller.resolveManifestList). It accepts either an "os/arch" pair or
+	// a bare "arch", in which case the OS defaults to the daemon's own.
+	Platform string
+	// MaxConcurrentDownloads is the maximum number of layer downloads this
+	// pull (and any other concurrent pull sharing the same daemon-wide
+	// xfer.TransferManager) is allowed to have in flight at once. Zero uses
+	// xfer.DefaultMaxConcurrentDownloads. The shared manager is built once,
+	// so only the value of the first pull the daemon performs takes effect;
+	// later pulls' values are ignored.
+	MaxConcurrentDownloads int
+	// AllowNondistributableArtifacts lists registry hostnames allowed to
+	// serve non-distributable (foreign) layers from the URLs declared in
+	// their manifest descriptor, via --allow-nondistributable-artifacts.
+	AllowNondistributableArtifacts []string
+	// Trusted requests that the tag be resolved through Notary trust data
+	// (see v2Puller.resolveTrustedTag) before the manifest is fetched,
+	// rather than trusting the registry's tag-to-manifest mapping directly.
+	Trusted bool
+}
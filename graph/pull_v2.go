@@ -1,16 +1,27 @@
 package graph
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"runtime"
+	"strings"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/digest"
 	"github.com/docker/distribution/manifest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/docker/distribution/metadata"
+	"github.com/docker/docker/distribution/xfer"
 	"github.com/docker/docker/image"
+	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/progressreader"
 	"github.com/docker/docker/pkg/streamformatter"
 	"github.com/docker/docker/pkg/stringid"
@@ -19,16 +30,47 @@ import (
 	"github.com/docker/docker/utils"
 	"github.com/docker/libtrust"
 	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
 )
 
 type v2Puller struct {
 	*TagStore
-	endpoint  registry.APIEndpoint
-	config    *ImagePullConfig
-	sf        *streamformatter.StreamFormatter
-	repoInfo  *registry.RepositoryInfo
-	repo      distribution.Repository
-	sessionID string
+	endpoint        registry.APIEndpoint
+	config          *ImagePullConfig
+	sf              *streamformatter.StreamFormatter
+	repoInfo        *registry.RepositoryInfo
+	repo            distribution.Repository
+	sessionID       string
+	transferManager *xfer.TransferManager
+	// distributionMetadataStore records diffID -> blob digest mappings
+	// observed during this pull so a later push of the same content can
+	// skip layers the target repository already has.
+	distributionMetadataStore *metadata.V2MetadataService
+	// notaryRepository, when set, builds the NotaryRepository used to
+	// resolve a trusted tag to its signed digest in resolveTrustedTag.
+	// Building a real Notary client needs configuration (server URL,
+	// on-disk trust cache, transport) this package has no business holding,
+	// so it's supplied by whatever constructs this puller instead of
+	// derived from p.trustService here.
+	notaryRepository func(repoInfo *registry.RepositoryInfo) (NotaryRepository, error)
+}
+
+var (
+	transferManagerOnce sync.Once
+	transferManager     *xfer.TransferManager
+)
+
+// sharedTransferManager returns the single xfer.TransferManager used by
+// every pull this daemon performs, constructing it with maxConcurrentDownloads
+// the first time it's needed. Building a fresh TransferManager per Pull call
+// would give each pull its own concurrency budget and its own in-flight-job
+// table, defeating both the global concurrency cap and the cross-pull
+// dedup of overlapping layer downloads it exists to provide.
+func sharedTransferManager(maxConcurrentDownloads int) *xfer.TransferManager {
+	transferManagerOnce.Do(func() {
+		transferManager = xfer.NewTransferManager(maxConcurrentDownloads)
+	})
+	return transferManager
 }
 
 func (p *v2Puller) Pull(tag string, dryRun bool) (fallback bool, err error) {
@@ -40,6 +82,13 @@ func (p *v2Puller) Pull(tag string, dryRun bool) (fallback bool, err error) {
 	}
 
 	p.sessionID = stringid.GenerateRandomID()
+	p.transferManager = sharedTransferManager(p.config.MaxConcurrentDownloads)
+
+	distributionMetadataStore, err := p.v2MetadataService()
+	if err != nil {
+		return true, err
+	}
+	p.distributionMetadataStore = distributionMetadataStore
 
 	if err := p.pullV2Repository(tag, dryRun); err != nil {
 		if registry.ContinueOnError(err) {
@@ -107,73 +156,294 @@ func (p *v2Puller) pullV2Repository(tag string, dryRun bool) (err error) {
 
 // downloadInfo is used to pass information from download to extractor
 type downloadInfo struct {
-	img         *image.Image
-	tmpFile     *os.File
-	digest      digest.Digest
-	layer       distribution.ReadSeekCloser
+	img     *image.Image
+	tmpFile *os.File
+	digest  digest.Digest
+	// diffID is the uncompressed content digest this layer is recorded
+	// under in the distribution/metadata store; for schema1 pulls, where
+	// there is no true DiffID available, it is a digest fabricated from the
+	// image ID instead.
+	diffID digest.Digest
+	// downloaded is set once this downloadInfo's own goroutine has
+	// actually fetched the content; if it stays false, another downloadInfo
+	// in this pull is fetching the same layer and the broadcaster should be
+	// waited on instead of reading tmpFile.
+	downloaded bool
+	verifier   digest.Verifier
+	// descriptor carries the layer's MediaType/URLs from the manifest so
+	// foreign layers can be fetched from their declared URLs if the registry
+	// itself returns blob-unknown for them.
+	descriptor  distribution.Descriptor
 	size        int64
 	err         chan error
 	poolKey     string
 	broadcaster *progressreader.Broadcaster
 }
 
+// mediaTypeForeignLayer is the schema2 media type for layers that are not
+// expected to be retrievable from the registry's blob store and instead
+// carry a list of external URLs to fetch them from (used for Windows base
+// image layers that can't be redistributed).
+const mediaTypeForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+
+// isForeignLayer reports whether desc describes a non-distributable layer
+// that must be fetched from its declared URLs rather than the registry.
+func isForeignLayer(desc distribution.Descriptor) bool {
+	return desc.MediaType == mediaTypeForeignLayer && len(desc.URLs) > 0
+}
+
 type errVerification struct{}
 
 func (errVerification) Error() string { return "verification failed" }
 
-func (p *v2Puller) download(di *downloadInfo) {
+// ImageConfigPullError is an error pulling the image config blob
+// referenced by a schema2 manifest.
+type ImageConfigPullError struct {
+	Err error
+}
+
+// Error returns the error string for ImageConfigPullError.
+func (e ImageConfigPullError) Error() string {
+	return "error pulling image configuration: " + e.Err.Error()
+}
+
+// NoMatchingManifestError is returned when a manifest list does not contain
+// an entry matching the requested (or the daemon's default) platform.
+type NoMatchingManifestError struct {
+	OS, Architecture string
+	Available        []string
+}
+
+// Error returns the error string for NoMatchingManifestError.
+func (e NoMatchingManifestError) Error() string {
+	return fmt.Sprintf("no matching manifest for %s/%s in the manifest list (available: %s)", e.OS, e.Architecture, strings.Join(e.Available, ", "))
+}
+
+// download submits di's blob fetch to the puller's TransferManager, which
+// bounds concurrency, dedups by digest against any other pull fetching the
+// same content, and retries transient failures with backoff. Progress
+// updates from the (possibly shared) transfer are relayed to di's own
+// broadcaster so every subscriber of this downloadInfo sees them. ctx is
+// scoped to the pullV2Tag call di belongs to, not to the (possibly
+// longer-lived) TransferManager itself. It governs the transfer only when
+// this call started it: cancelling it then stops the transfer for every
+// caller attached to it, while a call that attached to a transfer another
+// caller started keeps waiting until that transfer finishes.
+func (p *v2Puller) download(ctx context.Context, di *downloadInfo) {
 	logrus.Debugf("pulling blob %q to %s", di.digest, di.img.ID)
 
-	blobs := p.repo.Blobs(context.Background())
+	job, watcher := p.transferManager.Download(ctx, di.digest.String(), p.downloadFunc(di))
 
-	desc, err := blobs.Stat(context.Background(), di.digest)
-	if err != nil {
-		logrus.Debugf("Error statting layer: %v", err)
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		for prog := range watcher.C {
+			di.broadcaster.Write(p.sf.FormatProgress(stringid.TruncateID(di.img.ID), prog.Action, &jsonmessage.JSONProgress{
+				Current: prog.Current,
+				Total:   prog.Total,
+			}))
+		}
+	}()
+
+	<-job.Done()
+	job.Unwatch(watcher)
+	<-relayDone
+
+	if err := job.Err(); err != nil {
 		di.err <- err
 		return
 	}
-	di.size = desc.Size
 
-	layerDownload, err := blobs.Open(context.Background(), di.digest)
-	if err != nil {
-		logrus.Debugf("Error fetching layer: %v", err)
-		di.err <- err
-		return
+	logrus.Debugf("Downloaded %s to tempfile %s", di.img.ID, di.tmpFile.Name())
+	di.downloaded = true
+
+	di.err <- nil
+}
+
+// downloadFunc returns the xfer.DownloadFunc that performs a single
+// download attempt for di, resuming from offset when the registry supports
+// Range requests on the underlying transport.
+func (p *v2Puller) downloadFunc(di *downloadInfo) xfer.DownloadFunc {
+	return func(ctx context.Context, offset int64, progressOutput func(xfer.Progress)) (written int64, err error) {
+		layerDownload, resumed, err := p.openLayer(ctx, di, offset)
+		if err != nil {
+			logrus.Debugf("Error fetching layer: %v", err)
+			return offset, err
+		}
+		defer layerDownload.Close()
+
+		if !resumed {
+			// The reader starts over from byte 0, so di.tmpFile's write
+			// cursor (left wherever the previous, non-resumable attempt
+			// stopped) must be reset too; otherwise this attempt's content
+			// gets appended after whatever was already written instead of
+			// overwriting it, and the verifier below ends up "Verified" over
+			// a corrupt, oversized tmpFile.
+			if _, err := di.tmpFile.Seek(0, 0); err != nil {
+				return offset, err
+			}
+			if err := di.tmpFile.Truncate(0); err != nil {
+				return 0, err
+			}
+			offset = 0
+			di.verifier = nil
+		}
+		written = offset
+
+		if di.verifier == nil {
+			verifier, err := digest.NewDigestVerifier(di.digest)
+			if err != nil {
+				return written, err
+			}
+			di.verifier = verifier
+		}
+
+		progressOutput(xfer.Progress{ID: stringid.TruncateID(di.img.ID), Action: "Downloading", Current: written, Total: di.size})
+
+		buf := make([]byte, 32*1024)
+		reader := io.TeeReader(layerDownload, di.verifier)
+		for {
+			n, rerr := reader.Read(buf)
+			if n > 0 {
+				if _, werr := di.tmpFile.Write(buf[:n]); werr != nil {
+					return written, werr
+				}
+				written += int64(n)
+				progressOutput(xfer.Progress{ID: stringid.TruncateID(di.img.ID), Action: "Downloading", Current: written, Total: di.size})
+			}
+			if rerr == io.EOF {
+				break
+			}
+			if rerr != nil {
+				return written, rerr
+			}
+		}
+
+		progressOutput(xfer.Progress{ID: stringid.TruncateID(di.img.ID), Action: "Verifying Checksum"})
+
+		if !di.verifier.Verified() {
+			err := fmt.Errorf("filesystem layer verification failed for digest %s", di.digest)
+			logrus.Error(err)
+			return written, err
+		}
+
+		progressOutput(xfer.Progress{ID: stringid.TruncateID(di.img.ID), Action: "Download complete"})
+		return written, nil
 	}
-	defer layerDownload.Close()
+}
 
-	verifier, err := digest.NewDigestVerifier(di.digest)
+// openLayer opens a reader for di's content, resuming from offset when
+// possible. It always tries the registry's blob store first, exactly as a
+// distributable layer would be fetched; only for layers marked foreign
+// (schema2 media type application/vnd.docker.image.rootfs.foreign.diff.tar.gzip,
+// carrying a urls list) does a blob-unknown response fall back to fetching
+// from the declared URLs over plain HTTPS, subject to the daemon's
+// --allow-nondistributable-artifacts allowlist. The returned bool reports
+// whether offset was honored; if false, the caller must restart its
+// verifier and truncate its destination, since the reader starts from
+// byte 0.
+func (p *v2Puller) openLayer(ctx context.Context, di *downloadInfo, offset int64) (io.ReadCloser, bool, error) {
+	blobs := p.repo.Blobs(ctx)
+
+	desc, err := blobs.Stat(ctx, di.digest)
 	if err != nil {
-		di.err <- err
-		return
+		if err == distribution.ErrBlobUnknown && isForeignLayer(di.descriptor) {
+			logrus.Debugf("Layer %s not present in registry, falling back to declared URLs: %v", di.digest, err)
+			return p.openForeignLayer(ctx, di, offset)
+		}
+		return nil, false, err
 	}
+	di.size = desc.Size
 
-	reader := progressreader.New(progressreader.Config{
-		In:        ioutil.NopCloser(io.TeeReader(layerDownload, verifier)),
-		Out:       di.broadcaster,
-		Formatter: p.sf,
-		Size:      di.size,
-		NewLines:  false,
-		ID:        stringid.TruncateID(di.img.ID),
-		Action:    "Downloading",
-	})
-	io.Copy(di.tmpFile, reader)
+	layerDownload, err := blobs.Open(ctx, di.digest)
+	if err != nil {
+		if err == distribution.ErrBlobUnknown && isForeignLayer(di.descriptor) {
+			logrus.Debugf("Layer %s not present in registry, falling back to declared URLs: %v", di.digest, err)
+			return p.openForeignLayer(ctx, di, offset)
+		}
+		return nil, false, err
+	}
 
-	di.broadcaster.Write(p.sf.FormatProgress(stringid.TruncateID(di.img.ID), "Verifying Checksum", nil))
+	if offset > 0 {
+		if _, err := layerDownload.Seek(offset, 0); err != nil {
+			logrus.Debugf("Unable to resume download for %s at offset %d: %v", di.digest, offset, err)
+			if _, err := layerDownload.Seek(0, 0); err != nil {
+				layerDownload.Close()
+				return nil, false, err
+			}
+			return layerDownload, false, nil
+		}
+	}
+	return layerDownload, true, nil
+}
 
-	if !verifier.Verified() {
-		err = fmt.Errorf("filesystem layer verification failed for digest %s", di.digest)
-		logrus.Error(err)
-		di.err <- err
-		return
+// openForeignLayer fetches a non-distributable layer from the URLs
+// declared in its manifest descriptor, trying each in turn and only
+// failing once all are exhausted.
+func (p *v2Puller) openForeignLayer(ctx context.Context, di *downloadInfo, offset int64) (io.ReadCloser, bool, error) {
+	if !p.allowNondistributableArtifacts() {
+		return nil, false, fmt.Errorf("refusing to pull foreign layer %s from %s: registry %s is not in --allow-nondistributable-artifacts", di.digest, di.descriptor.URLs, p.repoInfo.Index.Name)
 	}
 
-	di.broadcaster.Write(p.sf.FormatProgress(stringid.TruncateID(di.img.ID), "Download complete", nil))
+	di.size = di.descriptor.Size
 
-	logrus.Debugf("Downloaded %s to tempfile %s", di.img.ID, di.tmpFile.Name())
-	di.layer = layerDownload
+	var lastErr error
+	for _, url := range di.descriptor.URLs {
+		if !isHTTPSURL(url) {
+			// A foreign layer is otherwise only checked against its digest
+			// after the full body is read; don't let a compromised or
+			// malicious registry downgrade that to a plaintext fetch by
+			// handing back an http:// URL.
+			lastErr = fmt.Errorf("refusing to fetch foreign layer %s from non-https URL %s", di.digest, url)
+			continue
+		}
 
-	di.err <- nil
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+
+		resp, err := ctxhttp.Do(ctx, http.DefaultClient, req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusPartialContent {
+			return resp.Body, true, nil
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp.Body, false, nil
+		}
+		resp.Body.Close()
+		lastErr = fmt.Errorf("unexpected status code %d fetching foreign layer from %s", resp.StatusCode, url)
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no URLs declared for foreign layer %s", di.digest)
+	}
+	return nil, false, lastErr
+}
+
+// isHTTPSURL reports whether rawurl is an absolute https:// URL.
+func isHTTPSURL(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	return err == nil && u.Scheme == "https"
+}
+
+// allowNondistributableArtifacts reports whether the puller's source
+// registry is allowlisted via --allow-nondistributable-artifacts to fetch
+// foreign (non-distributable) layers from arbitrary hosts.
+func (p *v2Puller) allowNondistributableArtifacts() bool {
+	host := p.repoInfo.Index.Name
+	for _, allowed := range p.config.AllowNondistributableArtifacts {
+		if allowed == host {
+			return true
+		}
+	}
+	return false
 }
 
 func (p *v2Puller) pullV2Tag(out io.Writer, tag, taggedName string, dryRun bool) (verified bool, err error) {
@@ -184,11 +454,51 @@ func (p *v2Puller) pullV2Tag(out io.Writer, tag, taggedName string, dryRun bool)
 		return false, err
 	}
 
-	manifest, err := manSvc.GetByTag(tag)
+	// If the user opted into Notary-based trust, resolve tag to the digest
+	// signed in the repository's trust data before fetching the manifest,
+	// so content integrity is established end-to-end by the existing
+	// digest-verification branch in validateManifest below. manifestTag,
+	// not tag, carries that resolution; tag itself is left as the user
+	// requested it so the local tag mapping is still recorded further down.
+	manifestTag := tag
+	if p.config.Trusted && !utils.DigestReference(tag) {
+		trustedRef, err := p.resolveTrustedTag(tag)
+		if err != nil {
+			return false, err
+		}
+		logrus.Debugf("Pulling trusted tag %q as %q", tag, trustedRef)
+		manifestTag = trustedRef
+	}
+
+	man, err := manSvc.GetByTag(manifestTag)
 	if err != nil {
 		return false, err
 	}
-	verified, err = p.validateManifest(manifest, tag)
+
+	if mfstList, ok := man.(*manifestlist.DeserializedManifestList); ok {
+		// manifestTag is the reference the caller actually asked for (or
+		// that trust resolved it to), and it describes mfstList itself, not
+		// whatever per-platform manifest resolveManifestList picks out of
+		// it. Check the list's own payload against manifestTag here, before
+		// swapping man out from under it: resolveManifestList only checks
+		// its chosen entry's digest against the value the list declares for
+		// it, it has no way to know what the caller originally requested.
+		if err := p.verifyManifestDigest(mfstList, manifestTag); err != nil {
+			return false, err
+		}
+		child, err := p.resolveManifestList(manSvc, mfstList, manifestTag)
+		if err != nil {
+			return false, err
+		}
+		man = child
+		// child's payload was already checked against the digest the list
+		// declared for it, so only the schema-specific checks remain;
+		// running the digest check again here would compare it against
+		// manifestTag, which is the list's digest, not its own.
+		verified, err = p.validateManifestContent(man, manifestTag)
+	} else {
+		verified, err = p.validateManifest(man, manifestTag)
+	}
 	if err != nil {
 		return false, err
 	}
@@ -198,10 +508,23 @@ func (p *v2Puller) pullV2Tag(out io.Writer, tag, taggedName string, dryRun bool)
 
 	out.Write(p.sf.FormatStatus(tag, "Pulling from %s", p.repo.Name()))
 
-	var downloads []*downloadInfo
-
-	var layerIDs []string
+	var (
+		downloads []*downloadInfo
+		layerIDs  []string
+	)
+
+	// ctx bounds every download started on behalf of this pullV2Tag call
+	// (and only those - the TransferManager they run through is shared
+	// daemon-wide). wg tracks the same set of goroutines. On any return,
+	// cancelling ctx asks them to give up, and wg.Wait() makes sure they
+	// actually have - and so are done touching their tmpFile/broadcaster -
+	// before the cleanup below tears those down.
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
 	defer func() {
+		cancel()
+		wg.Wait()
+
 		p.graph.Release(p.sessionID, layerIDs...)
 
 		for _, d := range downloads {
@@ -215,78 +538,24 @@ func (p *v2Puller) pullV2Tag(out io.Writer, tag, taggedName string, dryRun bool)
 		}
 	}()
 
-	var totalSize int64
-	totalSize = 0
-	nbLayers := 0
-
 	if dryRun {
 		fmt.Printf("**** Dry Run - nothing will be downloaded ****\n")
 	}
 
-	for i := len(manifest.FSLayers) - 1; i >= 0; i-- {
-
-		img, err := image.NewImgJSON([]byte(manifest.History[i].V1Compatibility))
-		if err != nil {
-			logrus.Debugf("error getting image v1 json: %v", err)
-			return false, err
-		}
-
-		p.graph.Retain(p.sessionID, img.ID)
-		layerIDs = append(layerIDs, img.ID)
-
-		// Check if exists
-		if p.graph.Exists(img.ID) {
-			logrus.Debugf("Image already exists: %s", img.ID)
-			out.Write(p.sf.FormatProgress(stringid.TruncateID(img.ID), "Already exists", nil))
-			continue
-		}
-
-		digest := manifest.FSLayers[i].BlobSum
-		blobs := p.repo.Blobs(context.Background())
-		desc, err := blobs.Stat(context.Background(), digest)
-		if err != nil {
-			logrus.Debugf("Error statting layer: %v", err)
-			return false, err
-		}
-
-		totalSize += desc.Size
-		nbLayers += 1
-		if dryRun {
-			logrus.Debugf("%v layer size is %v bytes", stringid.TruncateID(img.ID), desc.Size)
-			continue
-		}
-
-		out.Write(p.sf.FormatProgress(stringid.TruncateID(img.ID), "Pulling fs layer", nil))
-
-		d := &downloadInfo{
-			img:     img,
-			poolKey: "layer:" + img.ID,
-			digest:  digest,
-			// TODO: seems like this chan buffer solved hanging problem in go1.5,
-			// this can indicate some deeper problem that somehow we never take
-			// error from channel in loop below
-			err: make(chan error, 1),
-		}
-
-		tmpFile, err := ioutil.TempFile("", "GetImageBlob")
-		if err != nil {
-			return false, err
-		}
-		d.tmpFile = tmpFile
-
-		downloads = append(downloads, d)
-
-		broadcaster, found := p.poolAdd("pull", d.poolKey)
-		broadcaster.Add(out)
-		d.broadcaster = broadcaster
-		if found {
-			d.err <- nil
-		} else {
-			go p.download(d)
-		}
+	var totalSize int64
+	switch v := man.(type) {
+	case *manifest.SignedManifest:
+		downloads, layerIDs, totalSize, err = p.schema1Layers(ctx, &wg, out, v, dryRun)
+	case *schema2.DeserializedManifest:
+		downloads, layerIDs, totalSize, err = p.schema2Layers(ctx, &wg, out, v, dryRun)
+	default:
+		return false, fmt.Errorf("unsupported manifest format for tag %q", tag)
+	}
+	if err != nil {
+		return false, err
 	}
 	if dryRun {
-		out.Write(p.sf.FormatStatus(tag, "Dry Run: %v bytes to be downloaded, in %v layers", totalSize, nbLayers))
+		out.Write(p.sf.FormatStatus(tag, "Dry Run: %v bytes to be downloaded, in %v layers", totalSize, len(downloads)))
 		return true, nil
 	}
 
@@ -296,7 +565,7 @@ func (p *v2Puller) pullV2Tag(out io.Writer, tag, taggedName string, dryRun bool)
 			return false, err
 		}
 
-		if d.layer == nil {
+		if !d.downloaded {
 			// Wait for a different pull to download and extract
 			// this layer.
 			err = d.broadcaster.Wait()
@@ -325,13 +594,16 @@ func (p *v2Puller) pullV2Tag(out io.Writer, tag, taggedName string, dryRun bool)
 		if err := p.graph.SetDigest(d.img.ID, d.digest); err != nil {
 			return false, err
 		}
+		if err := p.recordV2Metadata(d.diffID, d.digest); err != nil {
+			return false, err
+		}
 
 		d.broadcaster.Write(p.sf.FormatProgress(stringid.TruncateID(d.img.ID), "Pull complete", nil))
 		d.broadcaster.Close()
 		tagUpdated = true
 	}
 
-	manifestDigest, _, err := digestFromManifest(manifest, p.repoInfo.LocalName)
+	manifestDigest, _, err := digestFromManifest(man, p.repoInfo.LocalName)
 	if err != nil {
 		return false, err
 	}
@@ -378,6 +650,308 @@ func (p *v2Puller) pullV2Tag(out io.Writer, tag, taggedName string, dryRun bool)
 	return tagUpdated, nil
 }
 
+// platformOverride parses the ImagePullConfig.Platform override (if any)
+// into an OS/architecture pair, defaulting each half left unspecified to
+// the daemon's own runtime.GOOS/GOARCH. platform may be "os/arch" or a bare
+// "arch", in which case the OS keeps its default.
+func platformOverride(platform string) (os, arch string) {
+	os, arch = runtime.GOOS, runtime.GOARCH
+	if platform == "" {
+		return os, arch
+	}
+	if parts := strings.SplitN(platform, "/", 2); len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return os, platform
+}
+
+// selectManifestDescriptor returns the entry in manifests matching
+// wantOS/wantArch, along with the "os/arch" strings of every entry seen (for
+// use in a NoMatchingManifestError if no entry matches).
+func selectManifestDescriptor(manifests []manifestlist.ManifestDescriptor, wantOS, wantArch string) (match *manifestlist.ManifestDescriptor, available []string) {
+	for i, d := range manifests {
+		available = append(available, d.Platform.OS+"/"+d.Platform.Architecture)
+		if d.Platform.OS == wantOS && d.Platform.Architecture == wantArch {
+			return &manifests[i], available
+		}
+	}
+	return nil, available
+}
+
+// resolveManifestList picks the manifest entry matching the daemon's
+// GOOS/GOARCH (or the p.config.Platform override, in "os/arch" or bare
+// "arch" form) out of a manifest list, fetches it by digest and verifies
+// its content against the digest declared in the list.
+func (p *v2Puller) resolveManifestList(manSvc distribution.ManifestService, mfstList *manifestlist.DeserializedManifestList, tag string) (distribution.Manifest, error) {
+	wantOS, wantArch := platformOverride(p.config.Platform)
+
+	match, available := selectManifestDescriptor(mfstList.Manifests, wantOS, wantArch)
+	if match == nil {
+		return nil, NoMatchingManifestError{OS: wantOS, Architecture: wantArch, Available: available}
+	}
+
+	man, err := manSvc.Get(match.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err := digest.NewDigestVerifier(match.Digest)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := man.Payload()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := verifier.Write(payload); err != nil {
+		return nil, err
+	}
+	if !verifier.Verified() {
+		return nil, fmt.Errorf("image verification failed for digest %s", match.Digest)
+	}
+
+	logrus.Debugf("resolved manifest list for tag %q to %s/%s (digest %s)", tag, wantOS, wantArch, match.Digest)
+	return man, nil
+}
+
+// recordV2Metadata records, in the puller's distribution/metadata store,
+// that diffID's content is known to exist on this pull's source repository
+// under blobDigest. It is called both for layers we actually download and
+// for ones we find already present locally, since in either case we've
+// just learned a mapping worth remembering for the next push.
+func (p *v2Puller) recordV2Metadata(diffID, blobDigest digest.Digest) error {
+	if p.distributionMetadataStore == nil {
+		return nil
+	}
+	return p.distributionMetadataStore.Add(diffID, p.repo.Name(), blobDigest)
+}
+
+// schema1Layers walks a schema1 manifest's FSLayers/History (newest first)
+// and builds the downloadInfo/layerID lists the same way pullV2Tag has
+// always done, fabricating the local image chain from the embedded
+// V1Compatibility JSON.
+func (p *v2Puller) schema1Layers(ctx context.Context, wg *sync.WaitGroup, out io.Writer, m *manifest.SignedManifest, dryRun bool) (downloads []*downloadInfo, layerIDs []string, totalSize int64, err error) {
+	for i := len(m.FSLayers) - 1; i >= 0; i-- {
+		img, err := image.NewImgJSON([]byte(m.History[i].V1Compatibility))
+		if err != nil {
+			logrus.Debugf("error getting image v1 json: %v", err)
+			return nil, nil, 0, err
+		}
+
+		p.graph.Retain(p.sessionID, img.ID)
+		layerIDs = append(layerIDs, img.ID)
+
+		// Schema1 has no true DiffID; fabricate a stand-in from the image
+		// ID so the blobsum we already know (from the manifest, whether or
+		// not we end up downloading it) can still be recorded.
+		dgst := m.FSLayers[i].BlobSum
+		diffID := digest.Digest("sha256:" + img.ID)
+
+		// Check if exists
+		if p.graph.Exists(img.ID) {
+			logrus.Debugf("Image already exists: %s", img.ID)
+			if err := p.recordV2Metadata(diffID, dgst); err != nil {
+				return nil, nil, 0, err
+			}
+			out.Write(p.sf.FormatProgress(stringid.TruncateID(img.ID), "Already exists", nil))
+			continue
+		}
+
+		blobs := p.repo.Blobs(context.Background())
+		desc, err := blobs.Stat(context.Background(), dgst)
+		if err != nil {
+			logrus.Debugf("Error statting layer: %v", err)
+			return nil, nil, 0, err
+		}
+		totalSize += desc.Size
+
+		if dryRun {
+			logrus.Debugf("%v layer size is %v bytes", stringid.TruncateID(img.ID), desc.Size)
+			continue
+		}
+
+		d, err := p.newDownload(ctx, wg, out, img, desc, diffID)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		downloads = append(downloads, d)
+	}
+	return downloads, layerIDs, totalSize, nil
+}
+
+// schema2Layers fetches the image config blob referenced by a schema2
+// manifest and uses its ordered rootfs.diff_ids (rather than the fabricated
+// schema1 V1Compatibility chain) as the source of truth for layer identity.
+// Each layer's local ID is the ChainID obtained by combining its DiffID with
+// its parent's ChainID, so a pushed image can be matched back up without
+// regenerating a new chain on every round-trip.
+func (p *v2Puller) schema2Layers(ctx context.Context, wg *sync.WaitGroup, out io.Writer, m *schema2.DeserializedManifest, dryRun bool) (downloads []*downloadInfo, layerIDs []string, totalSize int64, err error) {
+	configJSON, err := p.pullSchema2Config(m.Config.Digest)
+	if err != nil {
+		return nil, nil, 0, ImageConfigPullError{Err: err}
+	}
+
+	configImg, err := image.NewImgJSON(configJSON)
+	if err != nil {
+		return nil, nil, 0, ImageConfigPullError{Err: err}
+	}
+
+	diffIDs := configImg.RootFS.DiffIDs
+	if len(diffIDs) != len(m.Layers) {
+		return nil, nil, 0, fmt.Errorf("number of diff IDs in image config (%d) does not match number of layers (%d)", len(diffIDs), len(m.Layers))
+	}
+
+	layerHistory := historyForLayers(configImg.History)
+
+	var parent digest.Digest
+	for i, l := range m.Layers {
+		chainID := createChainID(parent, diffIDs[i])
+
+		img := &image.Image{ID: chainID.Hex()}
+		if parent != "" {
+			img.Parent = parent.Hex()
+		}
+		if i < len(layerHistory) {
+			h := layerHistory[i]
+			img.Comment = h.Comment
+			img.Author = h.Author
+			img.Created = h.Created
+		}
+		parent = chainID
+
+		layerIDs = append(layerIDs, img.ID)
+		p.graph.Retain(p.sessionID, img.ID)
+
+		if p.graph.Exists(img.ID) {
+			logrus.Debugf("Image already exists: %s", img.ID)
+			if err := p.recordV2Metadata(diffIDs[i], l.Digest); err != nil {
+				return nil, nil, 0, err
+			}
+			out.Write(p.sf.FormatProgress(stringid.TruncateID(img.ID), "Already exists", nil))
+			continue
+		}
+
+		desc := l
+		if !isForeignLayer(l) {
+			// Foreign layers aren't necessarily retrievable from the
+			// repository itself, so only stat layers we expect blobs.Stat to
+			// know about.
+			stat, err := p.repo.Blobs(context.Background()).Stat(context.Background(), l.Digest)
+			if err != nil {
+				logrus.Debugf("Error statting layer: %v", err)
+				return nil, nil, 0, err
+			}
+			desc = stat
+			desc.URLs = l.URLs
+			desc.MediaType = l.MediaType
+		}
+		totalSize += desc.Size
+
+		if dryRun {
+			logrus.Debugf("%v layer size is %v bytes", stringid.TruncateID(img.ID), desc.Size)
+			continue
+		}
+
+		d, err := p.newDownload(ctx, wg, out, img, desc, diffIDs[i])
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		downloads = append(downloads, d)
+	}
+	return downloads, layerIDs, totalSize, nil
+}
+
+// pullSchema2Config fetches the image config blob referenced by a schema2
+// manifest and verifies that its digest matches dgst.
+func (p *v2Puller) pullSchema2Config(dgst digest.Digest) ([]byte, error) {
+	blobs := p.repo.Blobs(context.Background())
+	configJSON, err := blobs.Get(context.Background(), dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err := digest.NewDigestVerifier(dgst)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := verifier.Write(configJSON); err != nil {
+		return nil, err
+	}
+	if !verifier.Verified() {
+		return nil, fmt.Errorf("image config verification failed for digest %s", dgst)
+	}
+	return configJSON, nil
+}
+
+// historyForLayers returns history's entries that actually produced a
+// filesystem diff, in order, dropping the "empty layer" entries commands
+// like ENV or CMD leave behind. The result lines up 1:1 with
+// schema2Layers's diffIDs/m.Layers, so historyForLayers(...)[i] is the
+// history entry for the i'th real layer.
+func historyForLayers(history []image.History) []image.History {
+	nonEmpty := make([]image.History, 0, len(history))
+	for _, h := range history {
+		if h.EmptyLayer {
+			continue
+		}
+		nonEmpty = append(nonEmpty, h)
+	}
+	return nonEmpty
+}
+
+// createChainID computes the ChainID for a layer given its parent's ChainID
+// (empty for the base layer) and the layer's own DiffID, following the same
+// algorithm the registry and other clients use: sha256(parent + " " + diffID).
+func createChainID(parent, diffID digest.Digest) digest.Digest {
+	if parent == "" {
+		return diffID
+	}
+	return digest.FromBytes([]byte(parent + " " + diffID))
+}
+
+// newDownload prepares a downloadInfo and either kicks off a fetch for desc
+// or, if a download for the same pool key is already in flight, hooks into
+// its broadcaster instead of starting a duplicate one. wg is incremented
+// synchronously, before the fetch's goroutine is spawned, so a caller that
+// calls wg.Wait() right after newDownload returns is guaranteed to block
+// until that goroutine (and only goroutines it or its siblings started)
+// have finished, regardless of how soon the caller gets there.
+func (p *v2Puller) newDownload(ctx context.Context, wg *sync.WaitGroup, out io.Writer, img *image.Image, desc distribution.Descriptor, diffID digest.Digest) (*downloadInfo, error) {
+	out.Write(p.sf.FormatProgress(stringid.TruncateID(img.ID), "Pulling fs layer", nil))
+
+	d := &downloadInfo{
+		img:        img,
+		poolKey:    "layer:" + img.ID,
+		digest:     desc.Digest,
+		diffID:     diffID,
+		descriptor: desc,
+		// TODO: seems like this chan buffer solved hanging problem in go1.5,
+		// this can indicate some deeper problem that somehow we never take
+		// error from channel in loop below
+		err: make(chan error, 1),
+	}
+
+	tmpFile, err := ioutil.TempFile("", "GetImageBlob")
+	if err != nil {
+		return nil, err
+	}
+	d.tmpFile = tmpFile
+
+	broadcaster, found := p.poolAdd("pull", d.poolKey)
+	broadcaster.Add(out)
+	d.broadcaster = broadcaster
+	if found {
+		d.err <- nil
+	} else {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.download(ctx, d)
+		}()
+	}
+	return d, nil
+}
+
 // verifyTrustedKeys checks the keys provided against the trust store,
 // ensuring that the provided keys are trusted for the namespace. The keys
 // provided from this method must come from the signatures provided as part of
@@ -411,29 +985,127 @@ func (p *v2Puller) verifyTrustedKeys(namespace string, keys []libtrust.PublicKey
 	return
 }
 
-func (p *v2Puller) validateManifest(m *manifest.SignedManifest, tag string) (verified bool, err error) {
+// ErrExpiredTrustData is returned by resolveTrustedTag when the
+// repository's root, targets, or snapshot trust data has expired; the CLI
+// should prompt the user to refresh trust data rather than retry silently.
+var ErrExpiredTrustData = errors.New("remote trust data has expired")
+
+// errTrustDataUnavailable wraps any other failure obtaining or decoding a
+// repository's Notary trust data, including malformed JSON returned by the
+// trust server, so callers never see a raw json.SyntaxError.
+type errTrustDataUnavailable struct {
+	Err error
+}
+
+// Error returns the error string for errTrustDataUnavailable.
+func (e errTrustDataUnavailable) Error() string {
+	return fmt.Sprintf("trust data unavailable: %v", e.Err)
+}
+
+// TrustedTarget is the signed metadata for one tag found in a repository's
+// Notary targets file: the digest and size resolveTrustedTag needs to
+// rewrite a tag-based pull into an equivalent, verifiable by-digest one.
+type TrustedTarget struct {
+	Digest digest.Digest
+	Size   int64
+}
+
+// NotaryRepository is the minimal per-repository Notary client surface
+// trusted-pull resolution needs, kept narrow so alternate implementations
+// don't have to satisfy the full notary client.Repository surface.
+// Implementations must return ErrExpiredTrustData directly (unwrapped)
+// when the underlying trust data has expired; any other failure is
+// wrapped by resolveTrustedTag into errTrustDataUnavailable.
+type NotaryRepository interface {
+	GetTargetByName(tag string) (*TrustedTarget, error)
+}
+
+// resolveTrustedTag looks up tag's signed target in the repository's
+// Notary trust data and returns the equivalent "<algorithm>:<hex>" digest
+// reference, so the rest of pullV2Tag can pull and verify by digest
+// instead of trusting the tag->manifest mapping the registry hands back.
+// This coexists with, and is independent of, the legacy tech-preview
+// verifyTrustedKeys/libtrust path above.
+func (p *v2Puller) resolveTrustedTag(tag string) (string, error) {
+	if p.notaryRepository == nil {
+		return "", errTrustDataUnavailable{Err: errors.New("trusted pull requires a configured Notary client")}
+	}
+	notaryRepo, err := p.notaryRepository(p.repoInfo)
+	if err != nil {
+		return "", errTrustDataUnavailable{Err: err}
+	}
+
+	target, err := notaryRepo.GetTargetByName(tag)
+	if err != nil {
+		if err == ErrExpiredTrustData {
+			return "", ErrExpiredTrustData
+		}
+		return "", errTrustDataUnavailable{Err: err}
+	}
+
+	logrus.Debugf("resolved trusted tag %q to %s (%d bytes)", tag, target.Digest, target.Size)
+	return target.Digest.String(), nil
+}
+
+// verifyManifestDigest checks m's payload against tag, when tag is itself a
+// digest reference; it is a no-op when pulling by tag name. This is the
+// digest half of validateManifest, factored out so a manifest list's own
+// payload can be verified against the originally requested reference before
+// it is resolved down to a per-platform child manifest, which must not be
+// re-checked against that same digest (see pullV2Tag).
+func (p *v2Puller) verifyManifestDigest(m distribution.Manifest, tag string) error {
+	manifestDigest, err := digest.ParseDigest(tag)
+	if err != nil {
+		return nil
+	}
+	verifier, err := digest.NewDigestVerifier(manifestDigest)
+	if err != nil {
+		return err
+	}
+	payload, err := m.Payload()
+	if err != nil {
+		return err
+	}
+	if _, err := verifier.Write(payload); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		err := fmt.Errorf("image verification failed for digest %s", manifestDigest)
+		logrus.Error(err)
+		return err
+	}
+	return nil
+}
+
+// validateManifestContent dispatches to the schema-specific validation for
+// the concrete manifest type returned by the registry, without checking m's
+// digest against tag (see verifyManifestDigest).
+func (p *v2Puller) validateManifestContent(m distribution.Manifest, tag string) (verified bool, err error) {
+	switch v := m.(type) {
+	case *manifest.SignedManifest:
+		return p.validateManifestSchema1(v, tag)
+	case *schema2.DeserializedManifest:
+		return p.validateManifestSchema2(v, tag)
+	}
+	return false, fmt.Errorf("unsupported manifest format for tag %q", tag)
+}
+
+// validateManifest checks the manifest's digest, if the tag is itself a
+// digest, and then dispatches to the schema-specific validation for the
+// concrete manifest type returned by the registry.
+func (p *v2Puller) validateManifest(m distribution.Manifest, tag string) (verified bool, err error) {
 	// If pull by digest, then verify the manifest digest. NOTE: It is
 	// important to do this first, before any other content validation. If the
 	// digest cannot be verified, don't even bother with those other things.
-	if manifestDigest, err := digest.ParseDigest(tag); err == nil {
-		verifier, err := digest.NewDigestVerifier(manifestDigest)
-		if err != nil {
-			return false, err
-		}
-		payload, err := m.Payload()
-		if err != nil {
-			return false, err
-		}
-		if _, err := verifier.Write(payload); err != nil {
-			return false, err
-		}
-		if !verifier.Verified() {
-			err := fmt.Errorf("image verification failed for digest %s", manifestDigest)
-			logrus.Error(err)
-			return false, err
-		}
+	if err := p.verifyManifestDigest(m, tag); err != nil {
+		return false, err
 	}
+	return p.validateManifestContent(m, tag)
+}
 
+// validateManifestSchema1 runs the schema1-specific checks: FSLayers/History
+// symmetry and the JWS signature verification against the trust store.
+func (p *v2Puller) validateManifestSchema1(m *manifest.SignedManifest, tag string) (verified bool, err error) {
 	// TODO(tiborvass): what's the usecase for having manifest == nil and err == nil ? Shouldn't be the error be "DoesNotExist" ?
 	if m == nil {
 		return false, fmt.Errorf("image manifest does not exist for tag %q", tag)
@@ -457,3 +1129,21 @@ func (p *v2Puller) validateManifest(m *manifest.SignedManifest, tag string) (ver
 	}
 	return verified, nil
 }
+
+// validateManifestSchema2 runs the schema2-specific checks. Schema2
+// manifests carry no JWS signature of their own; integrity is instead
+// established by the digest check above (when pulling by digest) and by
+// verifying the image config blob against manifest.Config.Digest when it is
+// fetched in schema2Layers.
+func (p *v2Puller) validateManifestSchema2(m *schema2.DeserializedManifest, tag string) (verified bool, err error) {
+	if m == nil {
+		return false, fmt.Errorf("image manifest does not exist for tag %q", tag)
+	}
+	if m.SchemaVersion != 2 {
+		return false, fmt.Errorf("unsupported schema version %d for tag %q", m.SchemaVersion, tag)
+	}
+	if len(m.Layers) == 0 {
+		return false, fmt.Errorf("no layers in manifest for tag %q", tag)
+	}
+	return false, nil
+}
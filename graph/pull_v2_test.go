@@ -0,0 +1,59 @@
+package graph
+
+import (
+	"testing"
+
+	"github.com/docker/distribution/manifest/manifestlist"
+)
+
+func descriptor(os, arch string) manifestlist.ManifestDescriptor {
+	d := manifestlist.ManifestDescriptor{}
+	d.Platform.OS = os
+	d.Platform.Architecture = arch
+	return d
+}
+
+func TestSelectManifestDescriptorMatch(t *testing.T) {
+	manifests := []manifestlist.ManifestDescriptor{
+		descriptor("linux", "arm"),
+		descriptor("linux", "amd64"),
+		descriptor("windows", "amd64"),
+	}
+
+	match, available := selectManifestDescriptor(manifests, "linux", "amd64")
+	if match == nil {
+		t.Fatalf("expected a match for linux/amd64, got none (available: %v)", available)
+	}
+	if match.Platform.OS != "linux" || match.Platform.Architecture != "amd64" {
+		t.Fatalf("matched wrong entry: %+v", match.Platform)
+	}
+	wantAvailable := []string{"linux/arm", "linux/amd64", "windows/amd64"}
+	if len(available) != len(wantAvailable) {
+		t.Fatalf("available = %v, want %v", available, wantAvailable)
+	}
+}
+
+func TestSelectManifestDescriptorNoMatch(t *testing.T) {
+	manifests := []manifestlist.ManifestDescriptor{
+		descriptor("linux", "arm"),
+		descriptor("windows", "amd64"),
+	}
+
+	match, available := selectManifestDescriptor(manifests, "linux", "amd64")
+	if match != nil {
+		t.Fatalf("expected no match for linux/amd64, got %+v", match.Platform)
+	}
+	wantAvailable := []string{"linux/arm", "windows/amd64"}
+	if len(available) != len(wantAvailable) {
+		t.Fatalf("available = %v, want %v", available, wantAvailable)
+	}
+}
+
+func TestPlatformOverride(t *testing.T) {
+	if os, arch := platformOverride("darwin/arm64"); os != "darwin" || arch != "arm64" {
+		t.Fatalf("platformOverride(%q) = %q/%q, want darwin/arm64", "darwin/arm64", os, arch)
+	}
+	if os, arch := platformOverride("arm64"); arch != "arm64" || os == "" {
+		t.Fatalf("platformOverride(%q) = %q/%q, want default os with arch arm64", "arm64", os, arch)
+	}
+}
@@ -0,0 +1,54 @@
+package graph
+
+import (
+	"io"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"golang.org/x/net/context"
+)
+
+// pushLayer uploads a single layer's content to repo, unless
+// layerAlreadyOnRegistry finds that repo is already known (from a prior
+// pull's recorded V2 metadata) to have identical content under some
+// digest, in which case the upload is skipped entirely - this is the
+// payoff recordV2Metadata exists for. content is only invoked when an
+// upload actually has to happen, so callers can defer opening the layer's
+// tar stream until it's known to be needed.
+func (store *TagStore) pushLayer(ctx context.Context, repo distribution.Repository, diffID digest.Digest, content func() (io.ReadCloser, error)) (digest.Digest, error) {
+	if dgst, ok := store.layerAlreadyOnRegistry(ctx, repo, diffID); ok {
+		logrus.Debugf("Layer %s already present on %s as %s, skipping upload", diffID, repo.Name(), dgst)
+		return dgst, nil
+	}
+
+	rc, err := content()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	bs := repo.Blobs(ctx)
+	writer, err := bs.Create(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer writer.Close()
+
+	if _, err := io.Copy(writer, rc); err != nil {
+		return "", err
+	}
+
+	desc, err := writer.Commit(ctx, distribution.Descriptor{})
+	if err != nil {
+		return "", err
+	}
+
+	if metadataService, err := store.v2MetadataService(); err != nil {
+		logrus.Errorf("Unable to access distribution metadata store: %v", err)
+	} else if err := metadataService.Add(diffID, repo.Name(), desc.Digest); err != nil {
+		logrus.Errorf("Unable to record distribution metadata for %s: %v", diffID, err)
+	}
+
+	return desc.Digest, nil
+}
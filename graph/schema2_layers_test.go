@@ -0,0 +1,35 @@
+package graph
+
+import (
+	"testing"
+
+	"github.com/docker/docker/image"
+)
+
+func TestHistoryForLayersDropsEmptyEntries(t *testing.T) {
+	history := []image.History{
+		{Comment: "layer 0", EmptyLayer: false},
+		{Comment: "ENV FOO=bar", EmptyLayer: true},
+		{Comment: "layer 1", EmptyLayer: false},
+	}
+
+	got := historyForLayers(history)
+	if len(got) != 2 {
+		t.Fatalf("historyForLayers returned %d entries, want 2: %+v", len(got), got)
+	}
+	if got[0].Comment != "layer 0" || got[1].Comment != "layer 1" {
+		t.Fatalf("historyForLayers = %+v, want entries for layer 0 and layer 1 in order", got)
+	}
+}
+
+func TestHistoryForLayersNoEmptyEntries(t *testing.T) {
+	history := []image.History{
+		{Comment: "layer 0"},
+		{Comment: "layer 1"},
+	}
+
+	got := historyForLayers(history)
+	if len(got) != len(history) {
+		t.Fatalf("historyForLayers returned %d entries, want %d", len(got), len(history))
+	}
+}